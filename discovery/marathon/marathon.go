@@ -14,15 +14,19 @@
 package marathon
 
 import (
+	"bufio"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"math/rand"
 	"net"
 	"net/http"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/go-kit/kit/log"
@@ -49,12 +53,48 @@ const (
 	portIndexLabel model.LabelName = metaLabelPrefix + "port_index"
 	// taskLabel contains the mesos task name of the app instance.
 	taskLabel model.LabelName = metaLabelPrefix + "task"
+	// taskHealthLabel is "true"/"false"/"unknown", based on the task's aggregated
+	// health check results.
+	taskHealthLabel model.LabelName = metaLabelPrefix + "task_health"
+	// taskHealthCheckConsecutiveFailuresLabel is the highest consecutive failure
+	// count across the task's health check results.
+	taskHealthCheckConsecutiveFailuresLabel model.LabelName = metaLabelPrefix + "task_health_check_consecutive_failures"
 
 	// portMappingLabelPrefix is the prefix for the application portMappings labels.
 	portMappingLabelPrefix = metaLabelPrefix + "port_mapping_label_"
 	// portDefinitionLabelPrefix is the prefix for the application portDefinitions labels.
 	portDefinitionLabelPrefix = metaLabelPrefix + "port_definition_label_"
 
+	// podLabelPrefix is the prefix for the pod labels.
+	podLabelPrefix = metaLabelPrefix + "pod_label_"
+	// podEndpointLabelPrefix is the prefix for the pod endpoint labels.
+	podEndpointLabelPrefix = metaLabelPrefix + "pod_endpoint_label_"
+
+	// podLabel is used for the name of the pod in Marathon.
+	podLabel model.LabelName = metaLabelPrefix + "pod"
+	// podContainerLabel is used for the name of the container within the pod.
+	podContainerLabel model.LabelName = metaLabelPrefix + "pod_container"
+	// podEndpointLabel is used for the name of the endpoint the target was built from.
+	podEndpointLabel model.LabelName = metaLabelPrefix + "pod_endpoint"
+	// podNetworkLabel is used for the name of the pod's primary network.
+	podNetworkLabel model.LabelName = metaLabelPrefix + "pod_network"
+
+	// podSourcePrefix distinguishes pod target group sources from app target group
+	// sources so the two can be merged into one set without key collisions.
+	podSourcePrefix = "pod:"
+
+	// segmentJobLabel carries a segment's "<prefix>_JOB" port label override.
+	segmentJobLabel model.LabelName = metaLabelPrefix + "segment_job"
+
+	// defaultSegmentLabelPrefix is the default SDConfig.SegmentLabelPrefix.
+	defaultSegmentLabelPrefix = "PROMETHEUS_SEGMENT"
+
+	// groupLabelsPrefix is the prefix for the labels of an app's enclosing group.
+	groupLabelsPrefix = metaLabelPrefix + "group_labels_"
+
+	// groupLabel holds the path of an app's immediate parent group, e.g. "/prod/team-a".
+	groupLabel model.LabelName = metaLabelPrefix + "group"
+
 	// Constants for instrumentation.
 	namespace = "prometheus"
 )
@@ -74,17 +114,54 @@ var (
 		})
 	// DefaultSDConfig is the default Marathon SD configuration.
 	DefaultSDConfig = SDConfig{
-		RefreshInterval: model.Duration(30 * time.Second),
+		RefreshInterval:    model.Duration(30 * time.Second),
+		HealthFilter:       healthFilterAll,
+		SegmentLabelPrefix: defaultSegmentLabelPrefix,
 	}
 )
 
+// Values accepted by SDConfig.HealthFilter.
+const (
+	// healthFilterAll keeps every task regardless of health (the historical behavior).
+	healthFilterAll = "all"
+	// healthFilterHealthy drops tasks whose aggregated health is not true, including
+	// tasks that haven't reported a health check result yet.
+	healthFilterHealthy = "healthy"
+	// healthFilterPassing drops only tasks with an explicit failing health check;
+	// tasks with no results yet (e.g. still starting up) are kept.
+	healthFilterPassing = "passing"
+)
+
+const (
+	// reconcileInterval is how often event-stream mode falls back to a full refresh
+	// (the same one updateServices performs in polling mode), to reconcile state
+	// and pick up any events that were missed.
+	reconcileInterval = 10 * time.Minute
+
+	// eventStreamMinBackoff and eventStreamMaxBackoff bound the jittered delay used
+	// before reconnecting a dropped Marathon event stream.
+	eventStreamMinBackoff = 1 * time.Second
+	eventStreamMaxBackoff = 30 * time.Second
+
+	// eventStreamMaxLineSize bounds a single SSE "data:" line. deployment_success
+	// events can embed the full JSON of every app touched by the deployment, which
+	// can comfortably exceed bufio.Scanner's 64KB default; size this generously so
+	// one oversized frame doesn't abort the whole stream.
+	eventStreamMaxLineSize = 10 * 1024 * 1024
+)
+
 // SDConfig is the configuration for services running on Marathon.
 type SDConfig struct {
-	Servers          []string                     `yaml:"servers,omitempty"`
-	RefreshInterval  model.Duration               `yaml:"refresh_interval,omitempty"`
-	AuthToken        config_util.Secret           `yaml:"auth_token,omitempty"`
-	AuthTokenFile    string                       `yaml:"auth_token_file,omitempty"`
-	HTTPClientConfig config_util.HTTPClientConfig `yaml:",inline"`
+	Servers            []string                     `yaml:"servers,omitempty"`
+	RefreshInterval    model.Duration               `yaml:"refresh_interval,omitempty"`
+	AuthToken          config_util.Secret           `yaml:"auth_token,omitempty"`
+	AuthTokenFile      string                       `yaml:"auth_token_file,omitempty"`
+	StreamEvents       bool                         `yaml:"stream_events,omitempty"`
+	HealthFilter       string                       `yaml:"health_filter,omitempty"`
+	SegmentLabelPrefix string                       `yaml:"segment_label_prefix,omitempty"`
+	IncludeGroups      []string                     `yaml:"include_groups,omitempty"`
+	ExcludeGroups      []string                     `yaml:"exclude_groups,omitempty"`
+	HTTPClientConfig   config_util.HTTPClientConfig `yaml:",inline"`
 }
 
 // UnmarshalYAML implements the yaml.Unmarshaler interface.
@@ -107,6 +184,11 @@ func (c *SDConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
 	if (len(c.HTTPClientConfig.BearerToken) > 0 || len(c.HTTPClientConfig.BearerTokenFile) > 0) && (len(c.AuthToken) > 0 || len(c.AuthTokenFile) > 0) {
 		return fmt.Errorf("marathon_sd: at most one of bearer_token, bearer_token_file, auth_token & auth_token_file must be configured")
 	}
+	switch c.HealthFilter {
+	case healthFilterAll, healthFilterHealthy, healthFilterPassing:
+	default:
+		return fmt.Errorf("marathon_sd: invalid health_filter %q, must be one of 'all', 'healthy' or 'passing'", c.HealthFilter)
+	}
 	return c.HTTPClientConfig.Validate()
 }
 
@@ -115,16 +197,35 @@ func init() {
 	prometheus.MustRegister(refreshDuration)
 }
 
-const appListPath string = "/v2/apps/?embed=apps.tasks"
+const (
+	appListPath   string = "/v2/apps/?embed=apps.tasks"
+	podListPath   string = "/v2/pods/::status"
+	groupListPath string = "/v2/groups?embed=group.groups&embed=group.apps.tasks"
+	eventsPath    string = "/v2/events"
+)
 
 // Discovery provides service discovery based on a Marathon instance.
 type Discovery struct {
 	client          *http.Client
 	servers         []string
 	refreshInterval time.Duration
-	lastRefresh     map[string]*targetgroup.Group
 	appsClient      AppListClient
+	appClient       AppClient
+	podsClient      PodListClient
+	groupsClient    GroupClient
+	useEventStream  bool
+	healthFilter    string
+	segmentPrefix   string
+	includeGroups   []string
+	excludeGroups   []string
 	logger          log.Logger
+
+	// mu guards lastRefresh and appCache, which are both read and written from
+	// the polling/reconcile goroutine and, in event-stream mode, concurrently
+	// from the goroutine running watchEvents.
+	mu          sync.Mutex
+	lastRefresh map[string]*targetgroup.Group
+	appCache    map[string]*App
 }
 
 // NewDiscovery returns a new Marathon Discovery.
@@ -152,6 +253,15 @@ func NewDiscovery(conf SDConfig, logger log.Logger) (*Discovery, error) {
 		servers:         conf.Servers,
 		refreshInterval: time.Duration(conf.RefreshInterval),
 		appsClient:      fetchApps,
+		appClient:       fetchApp,
+		podsClient:      fetchPods,
+		groupsClient:    fetchGroups,
+		useEventStream:  conf.StreamEvents,
+		healthFilter:    conf.HealthFilter,
+		segmentPrefix:   conf.SegmentLabelPrefix,
+		includeGroups:   conf.IncludeGroups,
+		excludeGroups:   conf.ExcludeGroups,
+		appCache:        map[string]*App{},
 		logger:          logger,
 	}, nil
 }
@@ -206,6 +316,11 @@ func (rt *authTokenFileRoundTripper) RoundTrip(request *http.Request) (*http.Res
 
 // Run implements the Discoverer interface.
 func (d *Discovery) Run(ctx context.Context, ch chan<- []*targetgroup.Group) {
+	if d.useEventStream {
+		d.runEventStream(ctx, ch)
+		return
+	}
+
 	for {
 		select {
 		case <-ctx.Done():
@@ -219,6 +334,235 @@ func (d *Discovery) Run(ctx context.Context, ch chan<- []*targetgroup.Group) {
 	}
 }
 
+// runEventStream seeds the app cache with a full refresh, then keeps it up to date by
+// subscribing to the Marathon event bus. A much longer-interval full refresh is kept
+// running alongside the stream to reconcile any events that were missed.
+func (d *Discovery) runEventStream(ctx context.Context, ch chan<- []*targetgroup.Group) {
+	if err := d.updateServices(ctx, ch); err != nil {
+		level.Error(d.logger).Log("msg", "Error while updating services", "err", err)
+	}
+
+	go d.watchEvents(ctx, ch)
+
+	reconcile := time.NewTicker(reconcileInterval)
+	defer reconcile.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-reconcile.C:
+			if err := d.updateServices(ctx, ch); err != nil {
+				level.Error(d.logger).Log("msg", "Error while updating services", "err", err)
+			}
+		}
+	}
+}
+
+// watchEvents keeps a Marathon event-stream connection open, reconnecting with a
+// jittered backoff whenever it drops. A full refresh is performed after every
+// disconnect so that target groups stay correct while the stream is down.
+func (d *Discovery) watchEvents(ctx context.Context, ch chan<- []*targetgroup.Group) {
+	backoff := eventStreamMinBackoff
+
+	for {
+		if ctx.Err() != nil {
+			return
+		}
+
+		err := d.streamEvents(ctx, ch)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			level.Error(d.logger).Log("msg", "Error while streaming Marathon events", "err", err)
+		}
+
+		if err := d.updateServices(ctx, ch); err != nil {
+			level.Error(d.logger).Log("msg", "Error while updating services", "err", err)
+		}
+
+		wait := backoff/2 + time.Duration(rand.Int63n(int64(backoff/2+1)))
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+
+		if backoff *= 2; backoff > eventStreamMaxBackoff {
+			backoff = eventStreamMaxBackoff
+		}
+	}
+}
+
+// streamEvents opens a long-lived connection to the Marathon event bus and processes
+// frames from it until the connection is closed, an error occurs, or ctx is done.
+func (d *Discovery) streamEvents(ctx context.Context, ch chan<- []*targetgroup.Group) error {
+	url := RandomEventsURL(d.servers)
+
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Accept", "text/event-stream")
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if (resp.StatusCode < 200) || (resp.StatusCode >= 300) {
+		return fmt.Errorf("non 2xx status '%v' response during marathon event stream", resp.StatusCode)
+	}
+
+	level.Debug(d.logger).Log("msg", "Connected to Marathon event stream", "url", url)
+
+	return d.processEventStream(resp.Body, ch)
+}
+
+// processEventStream reads SSE frames (blank-line-terminated "event:"/"data:" pairs) from
+// r and dispatches the decoded payloads as they arrive.
+func (d *Discovery) processEventStream(r io.Reader, ch chan<- []*targetgroup.Group) error {
+	var (
+		scanner   = bufio.NewScanner(r)
+		eventType string
+		dataLines []string
+	)
+	scanner.Buffer(make([]byte, 0, 64*1024), eventStreamMaxLineSize)
+
+	for scanner.Scan() {
+		line := scanner.Text()
+
+		switch {
+		case line == "":
+			if len(dataLines) > 0 {
+				d.handleEvent(eventType, strings.Join(dataLines, "\n"), ch)
+			}
+			eventType = ""
+			dataLines = nil
+		case strings.HasPrefix(line, "event:"):
+			eventType = strings.TrimSpace(strings.TrimPrefix(line, "event:"))
+		case strings.HasPrefix(line, "data:"):
+			dataLines = append(dataLines, strings.TrimSpace(strings.TrimPrefix(line, "data:")))
+		}
+	}
+	return scanner.Err()
+}
+
+// statusUpdateEvent is sent whenever a task's status changes, e.g. to TASK_RUNNING or
+// TASK_KILLED.
+type statusUpdateEvent struct {
+	AppID string `json:"appId"`
+}
+
+// deploymentSuccessEvent is sent when a deployment, which may touch several apps at
+// once, completes successfully.
+type deploymentSuccessEvent struct {
+	Plan struct {
+		Target struct {
+			Apps []App `json:"apps"`
+		} `json:"target"`
+	} `json:"plan"`
+}
+
+// appTerminatedEvent is sent when an app is removed from Marathon entirely.
+type appTerminatedEvent struct {
+	AppID string `json:"appId"`
+}
+
+// instanceHealthChangedEvent is sent whenever a task's aggregated health check result
+// changes.
+type instanceHealthChangedEvent struct {
+	AppID string `json:"appId"`
+}
+
+// handleEvent decodes a single SSE data payload according to its event type and
+// updates the affected app(s) in the cache.
+func (d *Discovery) handleEvent(eventType, data string, ch chan<- []*targetgroup.Group) {
+	switch eventType {
+	case "status_update_event":
+		var ev statusUpdateEvent
+		if err := json.Unmarshal([]byte(data), &ev); err != nil {
+			level.Error(d.logger).Log("msg", "Error decoding status_update_event", "err", err)
+			return
+		}
+		d.refreshApp(ev.AppID, ch)
+
+	case "deployment_success":
+		var ev deploymentSuccessEvent
+		if err := json.Unmarshal([]byte(data), &ev); err != nil {
+			level.Error(d.logger).Log("msg", "Error decoding deployment_success event", "err", err)
+			return
+		}
+		for i := range ev.Plan.Target.Apps {
+			d.refreshApp(ev.Plan.Target.Apps[i].ID, ch)
+		}
+
+	case "app_terminated_event":
+		var ev appTerminatedEvent
+		if err := json.Unmarshal([]byte(data), &ev); err != nil {
+			level.Error(d.logger).Log("msg", "Error decoding app_terminated_event", "err", err)
+			return
+		}
+		d.removeApp(ev.AppID, ch)
+
+	case "instance_health_changed_event":
+		var ev instanceHealthChangedEvent
+		if err := json.Unmarshal([]byte(data), &ev); err != nil {
+			level.Error(d.logger).Log("msg", "Error decoding instance_health_changed_event", "err", err)
+			return
+		}
+		d.refreshApp(ev.AppID, ch)
+	}
+}
+
+// refreshApp re-fetches a single app from Marathon, updates the in-memory app cache,
+// and pushes a target group update for just that app.
+func (d *Discovery) refreshApp(appID string, ch chan<- []*targetgroup.Group) {
+	if appID == "" {
+		return
+	}
+
+	app, err := d.appClient(d.client, RandomAppURL(d.servers, appID))
+	if err != nil {
+		level.Error(d.logger).Log("msg", "Error fetching app", "app", appID, "err", err)
+		return
+	}
+
+	d.mu.Lock()
+	d.appCache[appID] = app
+	d.mu.Unlock()
+
+	ch <- createTargetGroups(app, d.healthFilter, d.segmentPrefix)
+}
+
+// removeApp drops an app from the in-memory app cache and pushes removals for all of
+// its target groups, including any per-segment groups it had.
+func (d *Discovery) removeApp(appID string, ch chan<- []*targetgroup.Group) {
+	if appID == "" {
+		return
+	}
+
+	d.mu.Lock()
+	sources := []string{appID}
+	if old, ok := d.appCache[appID]; ok {
+		sources = sources[:0]
+		for _, group := range createTargetGroups(old, d.healthFilter, d.segmentPrefix) {
+			sources = append(sources, group.Source)
+		}
+	}
+	delete(d.appCache, appID)
+	d.mu.Unlock()
+
+	removals := make([]*targetgroup.Group, len(sources))
+	for i, source := range sources {
+		removals[i] = &targetgroup.Group{Source: source}
+	}
+	ch <- removals
+}
+
 func (d *Discovery) updateServices(ctx context.Context, ch chan<- []*targetgroup.Group) (err error) {
 	t0 := time.Now()
 	defer func() {
@@ -244,8 +588,13 @@ func (d *Discovery) updateServices(ctx context.Context, ch chan<- []*targetgroup
 	case ch <- all:
 	}
 
+	d.mu.Lock()
+	lastRefresh := d.lastRefresh
+	d.lastRefresh = targetMap
+	d.mu.Unlock()
+
 	// Remove services which did disappear.
-	for source := range d.lastRefresh {
+	for source := range lastRefresh {
 		_, ok := targetMap[source]
 		if !ok {
 			select {
@@ -257,27 +606,65 @@ func (d *Discovery) updateServices(ctx context.Context, ch chan<- []*targetgroup
 		}
 	}
 
-	d.lastRefresh = targetMap
 	return nil
 }
 
 func (d *Discovery) fetchTargetGroups() (map[string]*targetgroup.Group, error) {
-	url := RandomAppsURL(d.servers)
-	apps, err := d.appsClient(d.client, url)
+	apps, err := d.fetchAppList()
+	if err != nil {
+		return nil, err
+	}
+
+	// Seed the app cache from every full refresh (the initial one, the periodic
+	// poll, and event-stream mode's reconcile tick) so that removeApp always has
+	// an up-to-date app to recompute segment sources from, even for apps that
+	// haven't yet had an event of their own since the cache was created.
+	d.mu.Lock()
+	for i := range apps.Apps {
+		d.appCache[apps.Apps[i].ID] = &apps.Apps[i]
+	}
+	d.mu.Unlock()
+
+	groups := AppsToTargetGroups(apps, d.healthFilter, d.segmentPrefix)
+
+	// Pods are a Marathon 1.4+ feature; older servers 404 on this endpoint. Don't
+	// fail the whole refresh over that specific, expected case, just keep serving
+	// app-based target groups. Any other error (timeout, 5xx, ...) is propagated
+	// so the refresh fails outright and d.lastRefresh is left untouched, rather
+	// than churning every pod target as removed-then-rediscovered over a blip.
+	podsURL := RandomPodsURL(d.servers)
+	pods, err := d.podsClient(d.client, podsURL)
 	if err != nil {
+		if errors.Is(err, errPodsUnsupported) {
+			level.Debug(d.logger).Log("msg", "Marathon server does not support pods", "err", err)
+			return groups, nil
+		}
 		return nil, err
 	}
+	for source, group := range PodsToTargetGroups(pods) {
+		groups[source] = group
+	}
 
-	groups := AppsToTargetGroups(apps)
 	return groups, nil
 }
 
 // Task describes one instance of a service running on Marathon.
 type Task struct {
-	ID          string      `json:"id"`
-	Host        string      `json:"host"`
-	Ports       []uint32    `json:"ports"`
-	IPAddresses []IPAddress `json:"ipAddresses"`
+	ID                 string              `json:"id"`
+	Host               string              `json:"host"`
+	Ports              []uint32            `json:"ports"`
+	IPAddresses        []IPAddress         `json:"ipAddresses"`
+	HealthCheckResults []HealthCheckResult `json:"healthCheckResults"`
+}
+
+// HealthCheckResult describes the result of one of an app's health checks
+// against a single task.
+type HealthCheckResult struct {
+	Alive               bool   `json:"alive"`
+	ConsecutiveFailures int    `json:"consecutiveFailures"`
+	FirstSuccess        string `json:"firstSuccess"`
+	LastSuccess         string `json:"lastSuccess"`
+	LastFailure         string `json:"lastFailure"`
 }
 
 // IPAddress describes the address and protocol the container's network interface is bound to.
@@ -326,6 +713,18 @@ type App struct {
 	Container       Container         `json:"container"`
 	PortDefinitions []PortDefinition  `json:"portDefinitions"`
 	Networks        []Network         `json:"networks"`
+	HealthChecks    []HealthCheck     `json:"healthChecks"`
+
+	// GroupPath and GroupLabels are populated by fetchAppList when group filters
+	// are configured; they don't come from the app JSON itself.
+	GroupPath   string            `json:"-"`
+	GroupLabels map[string]string `json:"-"`
+}
+
+// HealthCheck describes a health check configured on an app.
+type HealthCheck struct {
+	Protocol string `json:"protocol"`
+	Path     string `json:"path"`
 }
 
 // isContainerNet checks if the app's first network is set to mode 'container'.
@@ -378,6 +777,39 @@ func parseAppJSON(body []byte) (*AppList, error) {
 	return apps, nil
 }
 
+// AppClient defines a function that can be used to get a single application from marathon.
+type AppClient func(client *http.Client, url string) (*App, error)
+
+// fetchApp requests a single application from a marathon server.
+func fetchApp(client *http.Client, url string) (*App, error) {
+	request, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+
+	if (resp.StatusCode < 200) || (resp.StatusCode >= 300) {
+		return nil, fmt.Errorf("Non 2xx status '%v' response during marathon service discovery", resp.StatusCode)
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	var wrapper struct {
+		App App `json:"app"`
+	}
+	if err := json.Unmarshal(body, &wrapper); err != nil {
+		return nil, fmt.Errorf("%v in %s", err, url)
+	}
+	return &wrapper.App, nil
+}
+
 // RandomAppsURL randomly selects a server from an array and creates
 // an URL pointing to the app list.
 func RandomAppsURL(servers []string) string {
@@ -386,46 +818,247 @@ func RandomAppsURL(servers []string) string {
 	return fmt.Sprintf("%s%s", server, appListPath)
 }
 
+// RandomAppURL randomly selects a server from an array and creates
+// an URL pointing to a single app, identified by appID.
+func RandomAppURL(servers []string, appID string) string {
+	server := servers[rand.Intn(len(servers))]
+	return fmt.Sprintf("%s/v2/apps%s?embed=app.tasks", server, appID)
+}
+
+// RandomEventsURL randomly selects a server from an array and creates
+// an URL pointing to the Marathon event bus.
+func RandomEventsURL(servers []string) string {
+	server := servers[rand.Intn(len(servers))]
+	return fmt.Sprintf("%s%s", server, eventsPath)
+}
+
+// Group describes a node in Marathon's hierarchical app group tree.
+type Group struct {
+	ID     string            `json:"id"`
+	Apps   []App             `json:"apps"`
+	Groups []Group           `json:"groups"`
+	Labels map[string]string `json:"labels"`
+}
+
+// GroupClient defines a function that can be used to get the root app group from marathon.
+type GroupClient func(client *http.Client, url string) (*Group, error)
+
+// fetchGroups requests the full app group tree from a marathon server.
+func fetchGroups(client *http.Client, url string) (*Group, error) {
+	request, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+
+	if (resp.StatusCode < 200) || (resp.StatusCode >= 300) {
+		return nil, fmt.Errorf("Non 2xx status '%v' response during marathon service discovery", resp.StatusCode)
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	root := &Group{}
+	if err := json.Unmarshal(body, root); err != nil {
+		return nil, fmt.Errorf("%v in %s", err, url)
+	}
+	return root, nil
+}
+
+// RandomGroupsURL randomly selects a server from an array and creates
+// an URL pointing to the root app group.
+func RandomGroupsURL(servers []string) string {
+	server := servers[rand.Intn(len(servers))]
+	return fmt.Sprintf("%s%s", server, groupListPath)
+}
+
+// walkGroups recursively visits group and its descendants, invoking fn for every
+// app found along the way with the path and labels of its immediate enclosing group.
+func walkGroups(group *Group, fn func(app *App, groupPath string, groupLabels map[string]string)) {
+	for i := range group.Apps {
+		fn(&group.Apps[i], group.ID, group.Labels)
+	}
+	for i := range group.Groups {
+		walkGroups(&group.Groups[i], fn)
+	}
+}
+
+// matchesGroupFilters reports whether appID passes the include/exclude group
+// filters, each of which is matched as a group-path prefix against the app ID:
+// "/prod/team-a" matches "/prod/team-a" and "/prod/team-a/svc", but not the
+// unrelated sibling "/prod/team-ab".
+func matchesGroupFilters(appID string, include, exclude []string) bool {
+	for _, prefix := range exclude {
+		if hasGroupPrefix(appID, prefix) {
+			return false
+		}
+	}
+	if len(include) == 0 {
+		return true
+	}
+	for _, prefix := range include {
+		if hasGroupPrefix(appID, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// hasGroupPrefix reports whether appID is prefix itself or a descendant of it
+// in the group tree, i.e. the match respects "/"-separated path boundaries.
+func hasGroupPrefix(appID, prefix string) bool {
+	prefix = strings.TrimSuffix(prefix, "/")
+	return appID == prefix || strings.HasPrefix(appID, prefix+"/")
+}
+
+// fetchAppList returns the set of apps to discover targets for. If any group
+// filter is configured, the full group tree is fetched and walked so that
+// __meta_marathon_group(_labels_*) can be attached and apps outside the
+// included subtree excluded; otherwise the plain app list is used.
+func (d *Discovery) fetchAppList() (*AppList, error) {
+	if len(d.includeGroups) == 0 && len(d.excludeGroups) == 0 {
+		return d.appsClient(d.client, RandomAppsURL(d.servers))
+	}
+
+	root, err := d.groupsClient(d.client, RandomGroupsURL(d.servers))
+	if err != nil {
+		return nil, err
+	}
+
+	apps := &AppList{}
+	walkGroups(root, func(app *App, groupPath string, groupLabels map[string]string) {
+		if !matchesGroupFilters(app.ID, d.includeGroups, d.excludeGroups) {
+			return
+		}
+		app.GroupPath = groupPath
+		app.GroupLabels = groupLabels
+		apps.Apps = append(apps.Apps, *app)
+	})
+	return apps, nil
+}
+
 // AppsToTargetGroups takes an array of Marathon apps and converts them into target groups.
-func AppsToTargetGroups(apps *AppList) map[string]*targetgroup.Group {
+func AppsToTargetGroups(apps *AppList, healthFilter, segmentLabelPrefix string) map[string]*targetgroup.Group {
 	tgroups := map[string]*targetgroup.Group{}
 	for _, a := range apps.Apps {
-		group := createTargetGroup(&a)
-		tgroups[group.Source] = group
+		for _, group := range createTargetGroups(&a, healthFilter, segmentLabelPrefix) {
+			tgroups[group.Source] = group
+		}
 	}
 	return tgroups
 }
 
-func createTargetGroup(app *App) *targetgroup.Group {
+// createTargetGroups builds the target group(s) for a single app. Normally this is
+// one group for the whole app, but if any of its ports carry a segment label
+// (see SDConfig.SegmentLabelPrefix), the labeled ports are split out into their
+// own group(s), keyed by "<app ID>::<segment name>", leaving any unlabeled ports
+// in the app's own group.
+func createTargetGroups(app *App, healthFilter, segmentLabelPrefix string) []*targetgroup.Group {
 	var (
-		targets = targetsForApp(app)
 		appName = model.LabelValue(app.ID)
 		image   = model.LabelValue(app.Container.Docker.Image)
-	)
-	tg := &targetgroup.Group{
-		Targets: targets,
-		Labels: model.LabelSet{
+		appLbls = model.LabelSet{
 			appLabel:   appName,
 			imageLabel: image,
-		},
-		Source: app.ID,
-	}
-
+		}
+	)
 	for ln, lv := range app.Labels {
 		ln = appLabelPrefix + strutil.SanitizeLabelName(ln)
-		tg.Labels[model.LabelName(ln)] = model.LabelValue(lv)
+		appLbls[model.LabelName(ln)] = model.LabelValue(lv)
 	}
 
-	return tg
+	if app.GroupPath != "" {
+		appLbls[groupLabel] = model.LabelValue(app.GroupPath)
+		for ln, lv := range app.GroupLabels {
+			ln = groupLabelsPrefix + strutil.SanitizeLabelName(ln)
+			appLbls[model.LabelName(ln)] = model.LabelValue(lv)
+		}
+	}
+
+	ports, labels, prefix := appPortsAndLabels(app)
+	segments := segmentPortIndices(labels, segmentLabelPrefix)
+
+	if len(segments) == 0 {
+		return []*targetgroup.Group{{
+			Targets: targetsForAppPorts(app, healthFilter, ports, labels, prefix, nil),
+			Labels:  appLbls,
+			Source:  app.ID,
+		}}
+	}
+
+	groups := make([]*targetgroup.Group, 0, len(segments)+1)
+
+	if unsegmented, ok := segments[""]; ok {
+		groups = append(groups, &targetgroup.Group{
+			Targets: targetsForAppPorts(app, healthFilter, ports, labels, prefix, unsegmented),
+			Labels:  appLbls,
+			Source:  app.ID,
+		})
+	}
+
+	for name, idx := range segments {
+		if name == "" {
+			continue
+		}
+
+		segLbls := appLbls.Clone()
+		applySegmentOverrides(segLbls, labels[idx[0]], segmentLabelPrefix)
+
+		groups = append(groups, &targetgroup.Group{
+			Targets: targetsForAppPorts(app, healthFilter, ports, labels, prefix, idx),
+			Labels:  segLbls,
+			Source:  app.ID + "::" + name,
+		})
+	}
+
+	return groups
 }
 
-func targetsForApp(app *App) []model.LabelSet {
-	targets := make([]model.LabelSet, 0, len(app.Tasks))
+// applySegmentOverrides projects a segment's "<prefix>_SCHEME", "<prefix>_PATH"
+// and "<prefix>_JOB" port labels onto standard __scheme__, __metrics_path__ and
+// __meta_marathon_segment_job labels.
+func applySegmentOverrides(tgLabels model.LabelSet, portLabels map[string]string, segmentLabelPrefix string) {
+	if scheme, ok := portLabels[segmentLabelPrefix+"_SCHEME"]; ok {
+		tgLabels[model.SchemeLabel] = model.LabelValue(scheme)
+	}
+	if path, ok := portLabels[segmentLabelPrefix+"_PATH"]; ok {
+		tgLabels[model.MetricsPathLabel] = model.LabelValue(path)
+	}
+	if job, ok := portLabels[segmentLabelPrefix+"_JOB"]; ok {
+		tgLabels[segmentJobLabel] = model.LabelValue(job)
+	}
+}
+
+// segmentPortIndices groups port indices by the value of their segmentLabelPrefix
+// label. Ports without that label are grouped under the "" key.
+func segmentPortIndices(labels []map[string]string, segmentLabelPrefix string) map[string][]int {
+	segments := map[string][]int{}
+	haveSegment := false
 
-	var ports []uint32
-	var labels []map[string]string
-	var prefix string
+	for i, l := range labels {
+		name := l[segmentLabelPrefix]
+		if name != "" {
+			haveSegment = true
+		}
+		segments[name] = append(segments[name], i)
+	}
 
+	if !haveSegment {
+		return nil
+	}
+	return segments
+}
+
+// appPortsAndLabels extracts the ports and Marathon labels defined on an app,
+// preferring (in order) container portMappings, docker portMappings, then
+// portDefinitions. prefix is the meta-label prefix to use for the labels found.
+func appPortsAndLabels(app *App) (ports []uint32, labels []map[string]string, prefix string) {
 	if len(app.Container.PortMappings) != 0 {
 		// In Marathon 1.5.x the "container.docker.portMappings" object was moved
 		// to "container.portMappings".
@@ -452,6 +1085,14 @@ func targetsForApp(app *App) []model.LabelSet {
 		prefix = portDefinitionLabelPrefix
 	}
 
+	return ports, labels, prefix
+}
+
+// targetsForAppPorts builds one target per (task, port) pair. If portIdx is
+// non-nil, only the listed port indices are considered; otherwise all ports are.
+func targetsForAppPorts(app *App, healthFilter string, ports []uint32, labels []map[string]string, prefix string, portIdx []int) []model.LabelSet {
+	targets := make([]model.LabelSet, 0, len(app.Tasks))
+
 	// Gather info about the app's 'tasks'. Each instance (container) is considered a task
 	// and can be reachable at one or more host:port endpoints.
 	for _, t := range app.Tasks {
@@ -464,15 +1105,25 @@ func targetsForApp(app *App) []model.LabelSet {
 			ports = t.Ports
 		}
 
+		health, failures := taskHealth(app, &t)
+		if !health.passes(healthFilter) {
+			continue
+		}
+
 		// Iterate over the ports we gathered using one of the methods above.
 		for i := 0; i < len(ports); i++ {
+			if portIdx != nil && !containsInt(portIdx, i) {
+				continue
+			}
 
 			// Each port represents a possible Prometheus target.
 			targetAddress := targetEndpoint(&t, ports[i], app.isContainerNet())
 			target := model.LabelSet{
-				model.AddressLabel: model.LabelValue(targetAddress),
-				taskLabel:          model.LabelValue(t.ID),
-				portIndexLabel:     model.LabelValue(strconv.Itoa(i)),
+				model.AddressLabel:                      model.LabelValue(targetAddress),
+				taskLabel:                               model.LabelValue(t.ID),
+				portIndexLabel:                          model.LabelValue(strconv.Itoa(i)),
+				taskHealthLabel:                         model.LabelValue(health),
+				taskHealthCheckConsecutiveFailuresLabel: model.LabelValue(strconv.Itoa(failures)),
 			}
 
 			// Gather all port labels and set them on the current target.
@@ -490,6 +1141,58 @@ func targetsForApp(app *App) []model.LabelSet {
 	return targets
 }
 
+// taskHealthStatus is the aggregated health of a task, as reported via the
+// __meta_marathon_task_health label.
+type taskHealthStatus string
+
+const (
+	taskHealthTrue    taskHealthStatus = "true"
+	taskHealthFalse   taskHealthStatus = "false"
+	taskHealthUnknown taskHealthStatus = "unknown"
+)
+
+// passes reports whether a task with this health status should be kept under
+// the given SDConfig.HealthFilter value. "healthy" requires an aggregated true
+// result; "passing" is more lenient and only drops an explicit failure,
+// keeping tasks that haven't reported a result yet.
+func (h taskHealthStatus) passes(healthFilter string) bool {
+	switch healthFilter {
+	case healthFilterHealthy:
+		return h == taskHealthTrue
+	case healthFilterPassing:
+		return h != taskHealthFalse
+	default:
+		return true
+	}
+}
+
+// taskHealth aggregates a task's health check results into a single status, along
+// with the highest consecutive failure count seen across its checks. Tasks
+// belonging to an app with no configured health checks are always healthy.
+func taskHealth(app *App, t *Task) (taskHealthStatus, int) {
+	if len(app.HealthChecks) == 0 {
+		return taskHealthTrue, 0
+	}
+	if len(t.HealthCheckResults) == 0 {
+		return taskHealthUnknown, 0
+	}
+
+	alive := true
+	failures := 0
+	for _, r := range t.HealthCheckResults {
+		if !r.Alive {
+			alive = false
+		}
+		if r.ConsecutiveFailures > failures {
+			failures = r.ConsecutiveFailures
+		}
+	}
+	if !alive {
+		return taskHealthFalse, failures
+	}
+	return taskHealthTrue, failures
+}
+
 // Generate a target endpoint string in host:port format.
 func targetEndpoint(task *Task, port uint32, containerNet bool) string {
 
@@ -526,3 +1229,190 @@ func extractPortMapping(portMappings []PortMapping, containerNet bool) ([]uint32
 
 	return ports, labels
 }
+
+// containsInt reports whether needle is present in haystack.
+func containsInt(haystack []int, needle int) bool {
+	for _, v := range haystack {
+		if v == needle {
+			return true
+		}
+	}
+	return false
+}
+
+// PodEndpoint describes a port exposed by a container within a pod.
+type PodEndpoint struct {
+	Name          string            `json:"name"`
+	ContainerPort uint32            `json:"containerPort"`
+	HostPort      uint32            `json:"hostPort"`
+	Labels        map[string]string `json:"labels"`
+}
+
+// PodContainer describes a single container definition within a pod.
+type PodContainer struct {
+	Name      string        `json:"name"`
+	Endpoints []PodEndpoint `json:"endpoints"`
+}
+
+// PodNetwork describes a network attached to a pod. When reported as part of a running
+// PodInstance, Addresses holds the addresses the pod was assigned on that network.
+type PodNetwork struct {
+	Name      string   `json:"name"`
+	Mode      string   `json:"mode"`
+	Addresses []string `json:"addresses"`
+}
+
+// PodInstance describes one running instance of a pod.
+type PodInstance struct {
+	ID        string       `json:"id"`
+	AgentHost string       `json:"agentHostname"`
+	Networks  []PodNetwork `json:"networks"`
+}
+
+// Pod describes a co-located group of containers running on Marathon.
+type Pod struct {
+	ID         string            `json:"id"`
+	Labels     map[string]string `json:"labels"`
+	Containers []PodContainer    `json:"containers"`
+	Networks   []PodNetwork      `json:"networks"`
+	Instances  []PodInstance     `json:"instances"`
+}
+
+// isContainerNet checks if the pod's first network is set to mode 'container'.
+func (pod Pod) isContainerNet() bool {
+	return len(pod.Networks) > 0 && pod.Networks[0].Mode == "container"
+}
+
+// PodList is a list of Marathon pods.
+type PodList struct {
+	Pods []Pod `json:"pods"`
+}
+
+// PodListClient defines a function that can be used to get the pod list from marathon.
+type PodListClient func(client *http.Client, url string) (*PodList, error)
+
+// errPodsUnsupported is returned by fetchPods when the Marathon server responds
+// with 404, which is what servers older than 1.4 do for /v2/pods since they
+// don't support pods at all.
+var errPodsUnsupported = errors.New("marathon server does not support pods (404)")
+
+// fetchPods requests the list of pods and their status from a marathon server.
+func fetchPods(client *http.Client, url string) (*PodList, error) {
+	request, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, errPodsUnsupported
+	}
+	if (resp.StatusCode < 200) || (resp.StatusCode >= 300) {
+		return nil, fmt.Errorf("Non 2xx status '%v' response during marathon service discovery", resp.StatusCode)
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	pods, err := parsePodJSON(body)
+	if err != nil {
+		return nil, fmt.Errorf("%v in %s", err, url)
+	}
+	return pods, nil
+}
+
+func parsePodJSON(body []byte) (*PodList, error) {
+	var pods []Pod
+	if err := json.Unmarshal(body, &pods); err != nil {
+		return nil, err
+	}
+	return &PodList{Pods: pods}, nil
+}
+
+// RandomPodsURL randomly selects a server from an array and creates
+// an URL pointing to the pod list.
+func RandomPodsURL(servers []string) string {
+	server := servers[rand.Intn(len(servers))]
+	return fmt.Sprintf("%s%s", server, podListPath)
+}
+
+// PodsToTargetGroups takes an array of Marathon pods and converts them into target groups.
+func PodsToTargetGroups(pods *PodList) map[string]*targetgroup.Group {
+	tgroups := map[string]*targetgroup.Group{}
+	for _, p := range pods.Pods {
+		group := createPodTargetGroup(&p)
+		tgroups[group.Source] = group
+	}
+	return tgroups
+}
+
+func createPodTargetGroup(pod *Pod) *targetgroup.Group {
+	tg := &targetgroup.Group{
+		Targets: targetsForPod(pod),
+		Labels: model.LabelSet{
+			podLabel: model.LabelValue(pod.ID),
+		},
+		Source: podSourcePrefix + pod.ID,
+	}
+
+	if len(pod.Networks) > 0 {
+		tg.Labels[podNetworkLabel] = model.LabelValue(pod.Networks[0].Name)
+	}
+
+	for ln, lv := range pod.Labels {
+		ln = podLabelPrefix + strutil.SanitizeLabelName(ln)
+		tg.Labels[model.LabelName(ln)] = model.LabelValue(lv)
+	}
+
+	return tg
+}
+
+// targetsForPod builds one target per (instance, container, endpoint), skipping
+// endpoints that don't expose a port for the pod's networking mode.
+func targetsForPod(pod *Pod) []model.LabelSet {
+	var targets []model.LabelSet
+
+	containerNet := pod.isContainerNet()
+
+	for _, inst := range pod.Instances {
+		host := inst.AgentHost
+		if containerNet && len(inst.Networks) > 0 && len(inst.Networks[0].Addresses) > 0 {
+			host = inst.Networks[0].Addresses[0]
+		}
+
+		for _, c := range pod.Containers {
+			for _, ep := range c.Endpoints {
+				var port uint32
+				if containerNet {
+					port = ep.ContainerPort
+				} else {
+					port = ep.HostPort
+				}
+				if port == 0 {
+					continue
+				}
+
+				target := model.LabelSet{
+					model.AddressLabel: model.LabelValue(net.JoinHostPort(host, strconv.Itoa(int(port)))),
+					podContainerLabel:  model.LabelValue(c.Name),
+					podEndpointLabel:   model.LabelValue(ep.Name),
+				}
+
+				for ln, lv := range ep.Labels {
+					ln = podEndpointLabelPrefix + strutil.SanitizeLabelName(ln)
+					target[model.LabelName(ln)] = model.LabelValue(lv)
+				}
+
+				targets = append(targets, target)
+			}
+		}
+	}
+
+	return targets
+}
@@ -0,0 +1,377 @@
+// Copyright 2016 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package marathon
+
+import (
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/discovery/targetgroup"
+)
+
+func TestProcessEventStreamDispatchesFrames(t *testing.T) {
+	d := &Discovery{
+		servers:  []string{"http://localhost"},
+		appCache: map[string]*App{},
+		logger:   log.NewNopLogger(),
+	}
+	d.appClient = func(client *http.Client, url string) (*App, error) {
+		return &App{ID: "/app1"}, nil
+	}
+
+	const sse = "event: status_update_event\n" +
+		"data: {\"appId\":\"/app1\"}\n" +
+		"\n" +
+		"event: app_terminated_event\n" +
+		"data: {\"appId\":\"/app2\"}\n" +
+		"\n"
+
+	ch := make(chan []*targetgroup.Group, 10)
+	if err := d.processEventStream(strings.NewReader(sse), ch); err != nil {
+		t.Fatalf("processEventStream() error = %v", err)
+	}
+	close(ch)
+
+	var got []*targetgroup.Group
+	for groups := range ch {
+		got = append(got, groups...)
+	}
+
+	if len(got) != 2 {
+		t.Fatalf("expected 2 target group updates, got %d", len(got))
+	}
+	if got[0].Source != "/app1" {
+		t.Errorf("expected the status_update_event to refresh /app1, got source %q", got[0].Source)
+	}
+	if got[1].Source != "/app2" {
+		t.Errorf("expected the app_terminated_event to remove /app2, got source %q", got[1].Source)
+	}
+}
+
+func TestProcessEventStreamIgnoresMalformedFrames(t *testing.T) {
+	d := &Discovery{
+		servers:  []string{"http://localhost"},
+		appCache: map[string]*App{},
+		logger:   log.NewNopLogger(),
+	}
+	called := false
+	d.appClient = func(client *http.Client, url string) (*App, error) {
+		called = true
+		return &App{ID: "/app1"}, nil
+	}
+
+	// A comment line (no "event:"/"data:" prefix), an event with no data line
+	// (nothing to dispatch), and one well-formed frame.
+	const sse = ": heartbeat\n" +
+		"\n" +
+		"event: status_update_event\n" +
+		"\n" +
+		"event: status_update_event\n" +
+		"data: {\"appId\":\"/app1\"}\n" +
+		"\n"
+
+	ch := make(chan []*targetgroup.Group, 10)
+	if err := d.processEventStream(strings.NewReader(sse), ch); err != nil {
+		t.Fatalf("processEventStream() error = %v", err)
+	}
+	close(ch)
+
+	var got []*targetgroup.Group
+	for groups := range ch {
+		got = append(got, groups...)
+	}
+	if len(got) != 1 {
+		t.Fatalf("expected exactly 1 dispatched update, got %d", len(got))
+	}
+	if !called {
+		t.Error("expected appClient to have been called for the one well-formed event")
+	}
+}
+
+func TestSegmentPortIndices(t *testing.T) {
+	tests := []struct {
+		name   string
+		labels []map[string]string
+		want   map[string][]int
+	}{
+		{
+			name:   "no ports",
+			labels: nil,
+			want:   nil,
+		},
+		{
+			name: "no segment labels",
+			labels: []map[string]string{
+				{"foo": "bar"},
+				{},
+			},
+			want: nil,
+		},
+		{
+			name: "mixed segmented and unsegmented ports",
+			labels: []map[string]string{
+				{"PROMETHEUS_SEGMENT": "metrics"},
+				{},
+				{"PROMETHEUS_SEGMENT": "admin"},
+				{"PROMETHEUS_SEGMENT": "metrics"},
+			},
+			want: map[string][]int{
+				"metrics": {0, 3},
+				"":        {1},
+				"admin":   {2},
+			},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got := segmentPortIndices(tc.labels, defaultSegmentLabelPrefix)
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("segmentPortIndices() = %#v, want %#v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestApplySegmentOverrides(t *testing.T) {
+	portLabels := map[string]string{
+		"PROMETHEUS_SEGMENT_SCHEME": "https",
+		"PROMETHEUS_SEGMENT_PATH":   "/admin/metrics",
+		"PROMETHEUS_SEGMENT_JOB":    "admin",
+	}
+
+	got := model.LabelSet{}
+	applySegmentOverrides(got, portLabels, defaultSegmentLabelPrefix)
+
+	want := model.LabelSet{
+		model.SchemeLabel:      "https",
+		model.MetricsPathLabel: "/admin/metrics",
+		segmentJobLabel:        "admin",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("applySegmentOverrides() = %#v, want %#v", got, want)
+	}
+}
+
+func TestApplySegmentOverridesPartial(t *testing.T) {
+	got := model.LabelSet{model.SchemeLabel: "http"}
+	applySegmentOverrides(got, map[string]string{"PROMETHEUS_SEGMENT_PATH": "/metrics"}, defaultSegmentLabelPrefix)
+
+	want := model.LabelSet{
+		model.SchemeLabel:      "http",
+		model.MetricsPathLabel: "/metrics",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("applySegmentOverrides() = %#v, want %#v", got, want)
+	}
+}
+
+func testAppWithSegments() *App {
+	return &App{
+		ID: "/app",
+		Container: Container{
+			PortMappings: []PortMapping{
+				{ContainerPort: 9090, ServicePort: 10000, Labels: map[string]string{
+					"PROMETHEUS_SEGMENT": "metrics",
+				}},
+				{ContainerPort: 9091, ServicePort: 10001, Labels: map[string]string{
+					"PROMETHEUS_SEGMENT":        "admin",
+					"PROMETHEUS_SEGMENT_SCHEME": "https",
+					"PROMETHEUS_SEGMENT_PATH":   "/admin/metrics",
+					"PROMETHEUS_SEGMENT_JOB":    "admin",
+				}},
+				{ContainerPort: 9092, ServicePort: 10002},
+			},
+		},
+		Tasks: []Task{
+			{ID: "task-1", Host: "host1"},
+		},
+	}
+}
+
+func TestCreateTargetGroupsSplitsSegments(t *testing.T) {
+	app := testAppWithSegments()
+
+	groups := createTargetGroups(app, healthFilterAll, defaultSegmentLabelPrefix)
+	if len(groups) != 3 {
+		t.Fatalf("expected 3 target groups (unsegmented + 2 segments), got %d", len(groups))
+	}
+
+	bySource := map[string]*targetgroup.Group{}
+	for _, g := range groups {
+		bySource[g.Source] = g
+	}
+
+	unsegmented, ok := bySource["/app"]
+	if !ok {
+		t.Fatalf("expected an unsegmented group with source %q", "/app")
+	}
+	if len(unsegmented.Targets) != 1 {
+		t.Errorf("expected 1 target in unsegmented group, got %d", len(unsegmented.Targets))
+	}
+	if got := unsegmented.Targets[0][portIndexLabel]; got != "2" {
+		t.Errorf("expected unsegmented target to keep its original port index 2, got %q", got)
+	}
+
+	admin, ok := bySource["/app::admin"]
+	if !ok {
+		t.Fatalf("expected a segment group with source %q", "/app::admin")
+	}
+	if got := admin.Labels[model.SchemeLabel]; got != "https" {
+		t.Errorf("expected admin segment to override scheme to https, got %q", got)
+	}
+	if got := admin.Labels[model.MetricsPathLabel]; got != "/admin/metrics" {
+		t.Errorf("expected admin segment to override metrics path, got %q", got)
+	}
+	if got := admin.Labels[segmentJobLabel]; got != "admin" {
+		t.Errorf("expected admin segment job label, got %q", got)
+	}
+	if len(admin.Targets) != 1 || admin.Targets[0][portIndexLabel] != "1" {
+		t.Errorf("expected admin segment to keep only port index 1, got %#v", admin.Targets)
+	}
+
+	metrics, ok := bySource["/app::metrics"]
+	if !ok {
+		t.Fatalf("expected a segment group with source %q", "/app::metrics")
+	}
+	if len(metrics.Targets) != 1 || metrics.Targets[0][portIndexLabel] != "0" {
+		t.Errorf("expected metrics segment to keep only port index 0, got %#v", metrics.Targets)
+	}
+}
+
+func TestTargetsForPodHostNetworking(t *testing.T) {
+	pod := &Pod{
+		ID: "/pod1",
+		Containers: []PodContainer{
+			{
+				Name: "c1",
+				Endpoints: []PodEndpoint{
+					{Name: "http", ContainerPort: 80, HostPort: 31000},
+					{Name: "unpublished", ContainerPort: 81},
+				},
+			},
+		},
+		Instances: []PodInstance{
+			{ID: "inst1", AgentHost: "10.0.0.1"},
+		},
+	}
+
+	targets := targetsForPod(pod)
+	if len(targets) != 1 {
+		t.Fatalf("expected 1 target (endpoint with no hostPort should be skipped in host networking), got %d", len(targets))
+	}
+	if got, want := targets[0][model.AddressLabel], model.LabelValue("10.0.0.1:31000"); got != want {
+		t.Errorf("expected address %q, got %q", want, got)
+	}
+	if got, want := targets[0][podEndpointLabel], model.LabelValue("http"); got != want {
+		t.Errorf("expected endpoint label %q, got %q", want, got)
+	}
+}
+
+func TestTargetsForPodContainerNetworking(t *testing.T) {
+	pod := &Pod{
+		ID:       "/pod1",
+		Networks: []PodNetwork{{Name: "dcos", Mode: "container"}},
+		Containers: []PodContainer{
+			{
+				Name: "c1",
+				Endpoints: []PodEndpoint{
+					{Name: "http", ContainerPort: 80, HostPort: 31000},
+					{Name: "no-container-port", HostPort: 31001},
+				},
+			},
+		},
+		Instances: []PodInstance{
+			{
+				ID:        "inst1",
+				AgentHost: "10.0.0.1",
+				Networks:  []PodNetwork{{Name: "dcos", Mode: "container", Addresses: []string{"9.0.0.5"}}},
+			},
+		},
+	}
+
+	targets := targetsForPod(pod)
+	if len(targets) != 1 {
+		t.Fatalf("expected 1 target (endpoint with no containerPort should be skipped in container networking), got %d", len(targets))
+	}
+	if got, want := targets[0][model.AddressLabel], model.LabelValue("9.0.0.5:80"); got != want {
+		t.Errorf("expected the pod's network address to be used, got %q, want %q", got, want)
+	}
+}
+
+func TestHasGroupPrefix(t *testing.T) {
+	tests := []struct {
+		appID, prefix string
+		want          bool
+	}{
+		{"/prod/team-a", "/prod/team-a", true},
+		{"/prod/team-a/svc", "/prod/team-a", true},
+		{"/prod/team-ab", "/prod/team-a", false},
+		{"/prod/team-ab/svc", "/prod/team-a", false},
+		{"/staging/team-a", "/prod/team-a", false},
+		{"/prod/team-a", "/prod/team-a/", true},
+	}
+	for _, tc := range tests {
+		if got := hasGroupPrefix(tc.appID, tc.prefix); got != tc.want {
+			t.Errorf("hasGroupPrefix(%q, %q) = %v, want %v", tc.appID, tc.prefix, got, tc.want)
+		}
+	}
+}
+
+func TestMatchesGroupFilters(t *testing.T) {
+	tests := []struct {
+		name             string
+		appID            string
+		include, exclude []string
+		want             bool
+	}{
+		{"no filters", "/prod/team-a/svc", nil, nil, true},
+		{"excluded sibling not affected", "/prod/team-ab/svc", nil, []string{"/prod/team-a"}, true},
+		{"excluded", "/prod/team-a/svc", nil, []string{"/prod/team-a"}, false},
+		{"included", "/prod/team-a/svc", []string{"/prod/team-a"}, nil, true},
+		{"not included", "/prod/team-b/svc", []string{"/prod/team-a"}, nil, false},
+		{"exclude wins over include", "/prod/team-a/svc", []string{"/prod"}, []string{"/prod/team-a"}, false},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := matchesGroupFilters(tc.appID, tc.include, tc.exclude); got != tc.want {
+				t.Errorf("matchesGroupFilters(%q) = %v, want %v", tc.appID, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestCreateTargetGroupsNoSegments(t *testing.T) {
+	app := &App{
+		ID: "/plain",
+		Container: Container{
+			PortMappings: []PortMapping{
+				{ContainerPort: 9090, ServicePort: 10000},
+			},
+		},
+		Tasks: []Task{{ID: "task-1", Host: "host1"}},
+	}
+
+	groups := createTargetGroups(app, healthFilterAll, defaultSegmentLabelPrefix)
+	if len(groups) != 1 {
+		t.Fatalf("expected a single target group for an app with no segments, got %d", len(groups))
+	}
+	if groups[0].Source != "/plain" {
+		t.Errorf("expected source %q, got %q", "/plain", groups[0].Source)
+	}
+}